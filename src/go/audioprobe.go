@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/oov/audio/wave"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// audioInfo is the normalized result of probing an audio file, matching the
+// Lua table schema returned by luaGetAudioInfo.
+type audioInfo struct {
+	SampleRate int64
+	Channels   int64
+	Bits       int64
+	Samples    int64
+}
+
+// audioProbe extracts an audioInfo from an audio stream whose format it
+// recognizes. Sniff inspects the leading bytes of the file to decide
+// whether Probe should be attempted; Probe is always called with f seeked
+// back to the start of the file.
+type audioProbe interface {
+	Sniff(header []byte) bool
+	Probe(f afero.File) (*audioInfo, error)
+}
+
+var audioProbes = []audioProbe{
+	wavProbe{},
+	flacProbe{},
+	oggProbe{},
+	mp3Probe{},
+}
+
+const audioProbeHeaderSize = 12
+
+// probeAudio dispatches to the first audioProbe whose Sniff recognizes f's
+// magic bytes, rather than relying on the file extension.
+func probeAudio(f afero.File) (*audioInfo, error) {
+	header := make([]byte, audioProbeHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header = header[:n]
+	for _, p := range audioProbes {
+		if !p.Sniff(header) {
+			continue
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return p.Probe(f)
+	}
+	return nil, errors.Errorf("unrecognized audio format")
+}
+
+// wavProbe handles Microsoft WAVE files via the existing wave package.
+type wavProbe struct{}
+
+func (wavProbe) Sniff(header []byte) bool {
+	return len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WAVE"
+}
+
+func (wavProbe) Probe(f afero.File) (*audioInfo, error) {
+	r, wfe, err := wave.NewLimitedReader(f)
+	if err != nil {
+		return nil, err
+	}
+	return &audioInfo{
+		SampleRate: int64(wfe.Format.SamplesPerSec),
+		Channels:   int64(wfe.Format.Channels),
+		Bits:       int64(wfe.Format.BitsPerSample),
+		Samples:    r.N / int64(wfe.Format.Channels) / int64(wfe.Format.BitsPerSample/8),
+	}, nil
+}
+
+// flacProbe reads just enough of a FLAC stream's metadata blocks to find
+// STREAMINFO, without decoding any audio frames.
+type flacProbe struct{}
+
+func (flacProbe) Sniff(header []byte) bool {
+	return len(header) >= 4 && string(header[:4]) == "fLaC"
+}
+
+func (flacProbe) Probe(f afero.File) (*audioInfo, error) {
+	if _, err := f.Seek(4, io.SeekStart); err != nil {
+		return nil, err
+	}
+	for {
+		var bh [4]byte
+		if _, err := io.ReadFull(f, bh[:]); err != nil {
+			return nil, errors.Wrap(err, "unexpected end of FLAC metadata")
+		}
+		last := bh[0]&0x80 != 0
+		blockType := bh[0] &^ 0x80
+		length := int(bh[1])<<16 | int(bh[2])<<8 | int(bh[3])
+		if blockType != 0 {
+			if _, err := f.Seek(int64(length), io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			if last {
+				return nil, errors.New("FLAC stream has no STREAMINFO block")
+			}
+			continue
+		}
+		if length < 34 {
+			return nil, errors.New("malformed FLAC STREAMINFO block")
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(f, data); err != nil {
+			return nil, err
+		}
+		// bytes 10-17 pack sampleRate(20) | channels-1(3) | bitsPerSample-1(5) | totalSamples(36)
+		v := binary.BigEndian.Uint64(data[10:18])
+		return &audioInfo{
+			SampleRate: int64(v >> 44),
+			Channels:   int64((v>>41)&0x7) + 1,
+			Bits:       int64((v>>36)&0x1f) + 1,
+			Samples:    int64(v & 0xfffffffff),
+		}, nil
+	}
+}
+
+// oggProbe reads the Vorbis identification header from the first Ogg page
+// and tracks the granule position of later pages to recover the sample
+// count.
+type oggProbe struct{}
+
+func (oggProbe) Sniff(header []byte) bool {
+	return len(header) >= 4 && string(header[:4]) == "OggS"
+}
+
+func (oggProbe) Probe(f afero.File) (*audioInfo, error) {
+	br := bufio.NewReader(f)
+	var info *audioInfo
+	for {
+		payload, granule, err := readOggPage(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			if len(payload) < 16 || string(payload[1:7]) != "vorbis" {
+				return nil, errors.New("not a Vorbis Ogg stream")
+			}
+			info = &audioInfo{
+				Channels:   int64(payload[11]),
+				SampleRate: int64(binary.LittleEndian.Uint32(payload[12:16])),
+			}
+		}
+		if granule >= 0 {
+			info.Samples = granule
+		}
+	}
+	if info == nil {
+		return nil, errors.New("empty Ogg stream")
+	}
+	return info, nil
+}
+
+func readOggPage(r *bufio.Reader) (payload []byte, granule int64, err error) {
+	hdr := make([]byte, 27)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return nil, 0, err
+	}
+	if string(hdr[:4]) != "OggS" {
+		return nil, 0, errors.New("bad Ogg page magic")
+	}
+	granule = int64(binary.LittleEndian.Uint64(hdr[6:14]))
+	segTable := make([]byte, hdr[26])
+	if _, err = io.ReadFull(r, segTable); err != nil {
+		return nil, 0, err
+	}
+	size := 0
+	for _, s := range segTable {
+		size += int(s)
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, 0, err
+	}
+	return payload, granule, nil
+}
+
+// mp3Probe scans MPEG audio frame headers (past any ID3v2 tag) to derive
+// sample rate and channel count, then estimates the sample count from the
+// frame count times samples-per-frame for the detected layer/version.
+type mp3Probe struct{}
+
+func (mp3Probe) Sniff(header []byte) bool {
+	if len(header) >= 3 && string(header[:3]) == "ID3" {
+		return true
+	}
+	return len(header) >= 2 && header[0] == 0xff && header[1]&0xe0 == 0xe0
+}
+
+// mp3BitrateTable maps {mpegVersion (1 or 2, with 2.5 sharing 2's table),
+// layer (1-3)} to the 15-entry kbps table indexed by the 4-bit bitrate
+// field (index 0 is "free", never selected here).
+var mp3BitrateTable = map[[2]int][15]int{
+	{1, 1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	{1, 2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+	{1, 3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	{2, 1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	{2, 2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	{2, 3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+}
+
+var mp3SampleRateTable = map[int][3]int{
+	1: {44100, 48000, 32000},
+	2: {22050, 24000, 16000},
+	3: {11025, 12000, 8000}, // MPEG2.5
+}
+
+var mp3SamplesPerFrame = map[[2]int]int{
+	{1, 1}: 384, {1, 2}: 1152, {1, 3}: 1152,
+	{2, 1}: 384, {2, 2}: 1152, {2, 3}: 576,
+}
+
+func (mp3Probe) Probe(f afero.File) (*audioInfo, error) {
+	br := bufio.NewReader(f)
+	if err := skipID3v2(br); err != nil {
+		return nil, err
+	}
+	var info *audioInfo
+	var samplesPerFrame, frames int
+	for {
+		b, err := br.Peek(4)
+		if err != nil {
+			break
+		}
+		mpegVersion, layer, ok := parseMP3Header(b)
+		if !ok {
+			br.Discard(1)
+			continue
+		}
+		bitrateIdx := int((b[2] >> 4) & 0xf)
+		sampleRateIdx := int((b[2] >> 2) & 0x3)
+		padding := int((b[2] >> 1) & 0x1)
+		channelMode := (b[3] >> 6) & 0x3
+		if bitrateIdx == 0 || bitrateIdx == 15 || sampleRateIdx == 3 {
+			br.Discard(1)
+			continue
+		}
+		tableVersion := mpegVersion
+		if tableVersion == 3 {
+			tableVersion = 2 // MPEG2.5 shares MPEG2's bitrate/layer tables
+		}
+		bitrate := mp3BitrateTable[[2]int{tableVersion, layer}][bitrateIdx] * 1000
+		sampleRate := mp3SampleRateTable[mpegVersion][sampleRateIdx]
+		spf := mp3SamplesPerFrame[[2]int{tableVersion, layer}]
+		// frameSize = (samples per frame / slotSize in bits) * bitrate /
+		// sampleRate, plus the padding slot. Slot size is 4 bytes for Layer
+		// I (coefficient spf/32, multiplied back out by 4) and 1 byte for
+		// Layer II/III (coefficient spf/8). A hardcoded 144 (1152/8, i.e.
+		// MPEG-1 Layer II/III only) would be ~2x too large for MPEG-2/2.5
+		// Layer III, whose frames carry only 576 samples.
+		frameSize := spf/8*bitrate/sampleRate + padding
+		if layer == 1 {
+			frameSize = (spf/32*bitrate/sampleRate + padding) * 4
+		}
+		if frameSize <= 0 {
+			break
+		}
+		if info == nil {
+			channels := 2
+			if channelMode == 3 {
+				channels = 1
+			}
+			info = &audioInfo{SampleRate: int64(sampleRate), Channels: int64(channels), Bits: 16}
+			samplesPerFrame = spf
+		}
+		frames++
+		if _, err := br.Discard(frameSize); err != nil {
+			break
+		}
+	}
+	if info == nil {
+		return nil, errors.New("no MP3 frames found")
+	}
+	info.Samples = int64(frames * samplesPerFrame)
+	return info, nil
+}
+
+// parseMP3Header decodes the MPEG version (1, 2, or 3 for MPEG2.5) and
+// layer (1-3) out of a 4-byte frame header, reporting ok=false if it is
+// not a valid frame sync.
+func parseMP3Header(b []byte) (mpegVersion, layer int, ok bool) {
+	if b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return 0, 0, false
+	}
+	switch (b[1] >> 3) & 0x3 {
+	case 0:
+		mpegVersion = 3 // MPEG2.5
+	case 2:
+		mpegVersion = 2
+	case 3:
+		mpegVersion = 1
+	default:
+		return 0, 0, false
+	}
+	switch (b[1] >> 1) & 0x3 {
+	case 1:
+		layer = 3
+	case 2:
+		layer = 2
+	case 3:
+		layer = 1
+	default:
+		return 0, 0, false
+	}
+	return mpegVersion, layer, true
+}
+
+func skipID3v2(r *bufio.Reader) error {
+	hdr, err := r.Peek(10)
+	if err != nil || string(hdr[:3]) != "ID3" {
+		return nil
+	}
+	size := int(hdr[6])<<21 | int(hdr[7])<<14 | int(hdr[8])<<7 | int(hdr[9])
+	_, err = r.Discard(10 + size)
+	return err
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestFlacProbe(t *testing.T) {
+	var v uint64
+	v |= 44100 << 44
+	v |= (2 - 1) << 41
+	v |= (16 - 1) << 36
+	v |= 1000
+
+	block := make([]byte, 34)
+	binary.BigEndian.PutUint64(block[10:18], v)
+
+	buf := []byte("fLaC")
+	header := []byte{0x80, 0, 0, byte(len(block))} // last-block flag set, type 0 (STREAMINFO)
+	buf = append(buf, header...)
+	buf = append(buf, block...)
+
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "x.flac", buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("x.flac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := (flacProbe{}).Probe(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SampleRate != 44100 || info.Channels != 2 || info.Bits != 16 || info.Samples != 1000 {
+		t.Fatalf("unexpected audioInfo: %+v", info)
+	}
+}
+
+func oggPage(granule int64, payload []byte) []byte {
+	hdr := make([]byte, 27)
+	copy(hdr[0:4], "OggS")
+	binary.LittleEndian.PutUint64(hdr[6:14], uint64(granule))
+	segs := (len(payload) + 254) / 255
+	if segs == 0 {
+		segs = 1
+	}
+	hdr[26] = byte(segs)
+	segTable := make([]byte, segs)
+	remaining := len(payload)
+	for i := range segTable {
+		n := remaining
+		if n > 255 {
+			n = 255
+		}
+		segTable[i] = byte(n)
+		remaining -= n
+	}
+	page := append(hdr, segTable...)
+	page = append(page, payload...)
+	return page
+}
+
+func TestOggProbe(t *testing.T) {
+	ident := make([]byte, 30)
+	ident[0] = 1
+	copy(ident[1:7], "vorbis")
+	ident[11] = 2 // channels
+	binary.LittleEndian.PutUint32(ident[12:16], 48000)
+
+	buf := oggPage(0, ident)
+	buf = append(buf, oggPage(9999, []byte{0})...)
+
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "x.ogg", buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("x.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := (oggProbe{}).Probe(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Channels != 2 || info.SampleRate != 48000 || info.Samples != 9999 {
+		t.Fatalf("unexpected audioInfo: %+v", info)
+	}
+}
+
+func mp3Frame(t *testing.T) []byte {
+	t.Helper()
+	const bitrate = 128000
+	const sampleRate = 44100
+	frameSize := 1152/8*bitrate/sampleRate + 0 // MPEG1 Layer III, bitrateIdx 9, sampleRateIdx 0, no padding
+	frame := make([]byte, frameSize)
+	frame[0] = 0xff
+	frame[1] = 0xfb // MPEG1, Layer III, no CRC
+	frame[2] = 0x90 // bitrateIdx=9 (128kbps), sampleRateIdx=0 (44100), no padding
+	frame[3] = 0x00 // stereo
+	return frame
+}
+
+func TestMp3ProbeFrameSize(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "x.mp3", mp3Frame(t), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("x.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := (mp3Probe{}).Probe(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SampleRate != 44100 || info.Channels != 2 {
+		t.Fatalf("unexpected audioInfo: %+v", info)
+	}
+	if info.Samples != 1152 {
+		t.Fatalf("expected one MPEG1 Layer III frame to report 1152 samples, got %d", info.Samples)
+	}
+}
+
+// TestMp3ProbeMPEG2Layer3FrameSize guards against hardcoding the MPEG-1
+// Layer II/III coefficient (144): MPEG-2 Layer III frames carry 576 samples
+// (coefficient 72), so a frame built at that size must be consumed exactly,
+// leaving the stream correctly desynced-free for a following frame.
+func TestMp3ProbeMPEG2Layer3FrameSize(t *testing.T) {
+	const bitrate = 64000 // mp3BitrateTable[{2,3}][8] == 64
+	const sampleRate = 22050
+	frameSize := 576/8*bitrate/sampleRate + 0
+	frame := make([]byte, frameSize)
+	frame[0] = 0xff
+	frame[1] = 0xf3 // MPEG2, Layer III, no CRC: version bits 10, layer bits 01
+	frame[2] = 0x80 // bitrateIdx=8 (64kbps in the MPEG2/2.5 table), sampleRateIdx=0 (22050), no padding
+	frame[3] = 0x00
+
+	// Two back-to-back frames: if frameSize were miscalculated the second
+	// frame's sync would land mid-garbage and parseMP3Header would fail.
+	buf := append(append([]byte{}, frame...), frame...)
+
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "x.mp3", buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Open("x.mp3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	info, err := (mp3Probe{}).Probe(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Samples != 2*576 {
+		t.Fatalf("expected two MPEG2 Layer III frames to report %d samples, got %d", 2*576, info.Samples)
+	}
+}
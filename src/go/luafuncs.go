@@ -2,10 +2,8 @@ package main
 
 import (
 	"log"
-	"os"
 	"unicode/utf16"
 
-	"github.com/oov/audio/wave"
 	lua "github.com/yuin/gopher-lua"
 	"golang.org/x/text/encoding/japanese"
 )
@@ -17,36 +15,48 @@ func luaDebugPrint(L *lua.LState) int {
 
 func luaFindRule(ss *setting) lua.LGFunction {
 	return func(L *lua.LState) int {
-		rule := ss.Find(L.ToString(1))
-		if rule == nil {
+		rule, _, groups, err := ss.Find(L.ToString(1))
+		if rule == nil || err != nil {
 			return 0
 		}
 		t := L.NewTable()
 		t.RawSetString("file", lua.LString(rule.File))
 		t.RawSetString("encoding", lua.LString(rule.Encoding))
 		t.RawSetString("layer", lua.LNumber(rule.Layer))
+		if len(groups) > 0 {
+			g := L.NewTable()
+			for name, v := range groups {
+				g.RawSetString(name, lua.LString(v))
+			}
+			t.RawSetString("groups", g)
+		}
 		L.Push(t)
 		return 1
 	}
 }
 
-func luaGetAudioInfo(L *lua.LState) int {
-	f, err := os.Open(L.ToString(1))
-	if err != nil {
-		return 0
-	}
-	defer f.Close()
-	r, wfe, err := wave.NewLimitedReader(f)
-	if err != nil {
-		return 0
+// luaGetAudioInfo accepts either a real filesystem path or a VFS URI
+// ("source:relative/path") referring to one of the [[source]] roots in
+// setting.toml.
+func luaGetAudioInfo(ss *setting) lua.LGFunction {
+	return func(L *lua.LState) int {
+		f, err := ss.FS().Open(L.ToString(1))
+		if err != nil {
+			return 0
+		}
+		defer f.Close()
+		info, err := probeAudio(f)
+		if err != nil {
+			return 0
+		}
+		t := L.NewTable()
+		t.RawSetString("samplerate", lua.LNumber(info.SampleRate))
+		t.RawSetString("channels", lua.LNumber(info.Channels))
+		t.RawSetString("bits", lua.LNumber(info.Bits))
+		t.RawSetString("samples", lua.LNumber(info.Samples))
+		L.Push(t)
+		return 1
 	}
-	t := L.NewTable()
-	t.RawSetString("samplerate", lua.LNumber(wfe.Format.SamplesPerSec))
-	t.RawSetString("channels", lua.LNumber(wfe.Format.Channels))
-	t.RawSetString("bits", lua.LNumber(wfe.Format.BitsPerSample))
-	t.RawSetString("samples", lua.LNumber(r.N/int64(wfe.Format.Channels)/int64(wfe.Format.BitsPerSample/8)))
-	L.Push(t)
-	return 1
 }
 
 func luaToSJIS(L *lua.LState) int {
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaHTTPClient backs the `http` table exposed to setup.lua. Requests are
+// restricted to the hostnames listed under allow_host in setting.toml so a
+// script cannot exfiltrate data to an arbitrary server; every redirect hop
+// is re-checked against the same allowlist so an allowed host can't just
+// 302 the request elsewhere.
+type luaHTTPClient struct {
+	timeout   time.Duration
+	allowHost map[string]struct{}
+}
+
+func newLuaHTTPClient(s *setting) *luaHTTPClient {
+	allow := make(map[string]struct{}, len(s.AllowHost))
+	for _, h := range s.AllowHost {
+		allow[h] = struct{}{}
+	}
+	timeout := time.Duration(s.HTTPTimeout * float64(time.Second))
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &luaHTTPClient{timeout: timeout, allowHost: allow}
+}
+
+// registerLuaHTTP installs the `http` table (get/post) into L.
+func registerLuaHTTP(L *lua.LState, s *setting) {
+	c := newLuaHTTPClient(s)
+	t := L.NewTable()
+	t.RawSetString("get", L.NewFunction(c.luaGet))
+	t.RawSetString("post", L.NewFunction(c.luaPost))
+	L.SetGlobal("http", t)
+}
+
+func (c *luaHTTPClient) hostAllowed(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	_, ok := c.allowHost[u.Hostname()]
+	return ok
+}
+
+func (c *luaHTTPClient) luaGet(L *lua.LState) int {
+	rawurl := L.ToString(1)
+	if !c.hostAllowed(rawurl) {
+		L.RaiseError("http: host is not allowed: %s", rawurl)
+		return 0
+	}
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		L.RaiseError("http: %s", err)
+		return 0
+	}
+	opt, _ := L.Get(2).(*lua.LTable)
+	return c.doRequest(L, req, opt)
+}
+
+func (c *luaHTTPClient) luaPost(L *lua.LState) int {
+	rawurl := L.ToString(1)
+	if !c.hostAllowed(rawurl) {
+		L.RaiseError("http: host is not allowed: %s", rawurl)
+		return 0
+	}
+	req, err := http.NewRequest(http.MethodPost, rawurl, bytes.NewReader([]byte(L.ToString(2))))
+	if err != nil {
+		L.RaiseError("http: %s", err)
+		return 0
+	}
+	opt, _ := L.Get(3).(*lua.LTable)
+	return c.doRequest(L, req, opt)
+}
+
+func (c *luaHTTPClient) doRequest(L *lua.LState, req *http.Request, opt *lua.LTable) int {
+	timeout := c.timeout
+	if opt != nil {
+		if headers, ok := opt.RawGetString("headers").(*lua.LTable); ok {
+			headers.ForEach(func(k, v lua.LValue) {
+				req.Header.Set(k.String(), v.String())
+			})
+		}
+		if t, ok := opt.RawGetString("timeout").(lua.LNumber); ok && t > 0 {
+			timeout = time.Duration(float64(t) * float64(time.Second))
+		}
+	}
+	cli := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !c.hostAllowed(req.URL.String()) {
+				return errors.Errorf("http: redirected host is not allowed: %s", req.URL)
+			}
+			return nil
+		},
+	}
+	resp, err := cli.Do(req)
+	if err != nil {
+		L.RaiseError("http: %s", err)
+		return 0
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		L.RaiseError("http: %s", err)
+		return 0
+	}
+	t := L.NewTable()
+	t.RawSetString("status", lua.LNumber(resp.StatusCode))
+	t.RawSetString("body", lua.LString(body))
+	h := L.NewTable()
+	for k, v := range resp.Header {
+		h.RawSetString(k, lua.LString(strings.Join(v, ", ")))
+	}
+	t.RawSetString("headers", h)
+	L.Push(t)
+	return 1
+}
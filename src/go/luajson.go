@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// luaJSONArrayMeta tags Lua tables produced by json.decode from a JSON
+// array, so json.encode can tell them apart from tables that represent a
+// JSON object.
+const luaJSONArrayMeta = "json.array"
+
+// registerLuaJSON installs the `json` table (encode/decode) into L.
+func registerLuaJSON(L *lua.LState) {
+	t := L.NewTable()
+	t.RawSetString("encode", L.NewFunction(luaJSONEncode))
+	t.RawSetString("decode", L.NewFunction(luaJSONDecode))
+	L.SetGlobal("json", t)
+}
+
+func luaJSONEncode(L *lua.LState) int {
+	b, err := json.Marshal(luaToGo(L.Get(1)))
+	if err != nil {
+		L.RaiseError("json: %s", err)
+		return 0
+	}
+	L.Push(lua.LString(b))
+	return 1
+}
+
+func luaJSONDecode(L *lua.LState) int {
+	var v interface{}
+	if err := json.Unmarshal([]byte(L.ToString(1)), &v); err != nil {
+		L.RaiseError("json: %s", err)
+		return 0
+	}
+	L.Push(goToLua(L, v))
+	return 1
+}
+
+func goToLua(L *lua.LState, v interface{}) lua.LValue {
+	switch vv := v.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(vv)
+	case float64:
+		return lua.LNumber(vv)
+	case string:
+		return lua.LString(vv)
+	case []interface{}:
+		t := L.NewTable()
+		for i, e := range vv {
+			t.RawSetInt(i+1, goToLua(L, e))
+		}
+		t.Metatable = arrayMetatable(L)
+		return t
+	case map[string]interface{}:
+		t := L.NewTable()
+		for k, e := range vv {
+			t.RawSetString(k, goToLua(L, e))
+		}
+		return t
+	default:
+		return lua.LNil
+	}
+}
+
+func luaToGo(v lua.LValue) interface{} {
+	switch vv := v.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		return bool(vv)
+	case lua.LNumber:
+		return float64(vv)
+	case lua.LString:
+		return string(vv)
+	case *lua.LTable:
+		if isLuaArray(vv) {
+			arr := make([]interface{}, 0, vv.Len())
+			for i := 1; i <= vv.Len(); i++ {
+				arr = append(arr, luaToGo(vv.RawGetInt(i)))
+			}
+			return arr
+		}
+		m := make(map[string]interface{})
+		vv.ForEach(func(k, val lua.LValue) {
+			m[k.String()] = luaToGo(val)
+		})
+		return m
+	default:
+		return nil
+	}
+}
+
+// isLuaArray reports whether t should be encoded as a JSON array: either it
+// carries the metatable tag set by json.decode, or (for tables built
+// directly in Lua) its keys form a dense 1..n integer sequence.
+func isLuaArray(t *lua.LTable) bool {
+	if _, ok := t.Metatable.(*lua.LTable); ok && t.Metatable == sharedArrayMetatable {
+		return true
+	}
+	n := t.Len()
+	count := 0
+	keys := make([]int, 0, n)
+	t.ForEach(func(k, _ lua.LValue) {
+		if num, ok := k.(lua.LNumber); ok {
+			keys = append(keys, int(num))
+		}
+		count++
+	})
+	if count != n || count != len(keys) {
+		return count == 0
+	}
+	sort.Ints(keys)
+	for i, k := range keys {
+		if k != i+1 {
+			return false
+		}
+	}
+	return true
+}
+
+var sharedArrayMetatable *lua.LTable
+
+func arrayMetatable(L *lua.LState) *lua.LTable {
+	if sharedArrayMetatable == nil {
+		sharedArrayMetatable = L.NewTypeMetatable(luaJSONArrayMeta)
+	}
+	return sharedArrayMetatable
+}
@@ -13,27 +13,37 @@ import (
 
 	toml "github.com/pelletier/go-toml"
 	"github.com/pkg/errors"
+	"github.com/spf13/afero"
 	"golang.org/x/text/encoding/japanese"
 	"golang.org/x/text/encoding/unicode"
 )
 
 type rule struct {
-	Dir      string
-	File     string
-	Text     string
-	Encoding string
-	Layer    int
-	Modifier string
+	Dir       string
+	File      string
+	Text      string
+	Encoding  string
+	Layer     int
+	Modifier  string
+	Recursive bool
+	Depth     int
+	Source    string
 
 	fileRE *regexp.Regexp
 	textRE *regexp.Regexp
+	dirRE  *regexp.Regexp
 }
 
 type setting struct {
-	BaseDir   string
-	Delta     float64
-	Freshness float64
-	Rule      []rule
+	BaseDir     string
+	Delta       float64
+	Freshness   float64
+	HTTPTimeout float64
+	AllowHost   []string
+	Source      []sourceConfig
+	Rule        []rule
+
+	fs afero.Fs
 }
 
 func makeWildcard(s string) (*regexp.Regexp, error) {
@@ -62,6 +72,89 @@ func makeWildcard(s string) (*regexp.Regexp, error) {
 	return regexp.Compile(string(buf))
 }
 
+// recurseSuffix matches zero or more additional nested path segments at the
+// end of a pattern: "", "/a", "/a/b", .... It is used for a trailing "**"
+// segment and for rule.Recursive, both of which must also match the fixed
+// prefix itself with no nested directories at all. depth <= 0 means an
+// unbounded number of nested directories.
+func recurseSuffix(depth int) string {
+	if depth > 0 {
+		return fmt.Sprintf(`(?:/[^/]+){0,%d}`, depth)
+	}
+	return `(?:/[^/]+)*`
+}
+
+// recurseInfix matches zero or more nested path segments sitting between
+// two fixed segments of a pattern: "", "a/", "a/b/", .... It is used for a
+// "**" segment that is not the last one, e.g. "chara/**/take_*", where a
+// literal separator is still required before the following segment.
+func recurseInfix(depth int) string {
+	if depth > 0 {
+		return fmt.Sprintf(`(?:[^/]+/){0,%d}`, depth)
+	}
+	return `(?:[^/]+/)*`
+}
+
+// makeDirMatcher compiles r.Dir into a directory-matching regular
+// expression. A "**" path segment, or Recursive being set, matches any
+// number of nested directories (bounded by depth when depth > 0), and a
+// segment containing "*"/"?" is captured as a named group ("g0", "g1", ...)
+// so the matched path components can be exposed to Lua.
+func makeDirMatcher(dir string, recursive bool, depth int) (*regexp.Regexp, error) {
+	dir = strings.Trim(filepath.ToSlash(dir), "/")
+	var segs []string
+	if dir != "" {
+		segs = strings.Split(dir, "/")
+	}
+	buf := make([]byte, 0, 128)
+	buf = append(buf, '^')
+	group := 0
+	for i, seg := range segs {
+		if seg == "**" {
+			if i == len(segs)-1 {
+				// Trailing "**": matches the fixed prefix itself, or any
+				// number of directories nested below it.
+				buf = append(buf, recurseSuffix(depth)...)
+				continue
+			}
+			// "**" in the middle: still needs a separator before it (the
+			// following segment is joined on below, without one, since the
+			// infix fragment already ends in "/" whenever it matches at
+			// least one directory).
+			if i > 0 {
+				buf = append(buf, '/')
+			}
+			buf = append(buf, recurseInfix(depth)...)
+			continue
+		}
+		if i > 0 && segs[i-1] != "**" {
+			buf = append(buf, '/')
+		}
+		if strings.ContainsAny(seg, "*?") {
+			buf = append(buf, fmt.Sprintf("(?P<g%d>", group)...)
+			group++
+			for _, c := range []byte(seg) {
+				switch c {
+				case '*':
+					buf = append(buf, `[^/]*?`...)
+				case '?':
+					buf = append(buf, `[^/]`...)
+				default:
+					buf = append(buf, regexp.QuoteMeta(string(c))...)
+				}
+			}
+			buf = append(buf, ')')
+			continue
+		}
+		buf = append(buf, regexp.QuoteMeta(seg)...)
+	}
+	if recursive {
+		buf = append(buf, recurseSuffix(depth)...)
+	}
+	buf = append(buf, '$')
+	return regexp.Compile(string(buf))
+}
+
 func decodeTOML(r io.Reader, v interface{}) (err error) {
 	defer func() {
 		if rcv := recover(); rcv != nil {
@@ -129,17 +222,33 @@ func newSetting(path string) (*setting, error) {
 	if err != nil {
 		return nil, tomlError(err, config, "freshness")
 	}
+	s.HTTPTimeout, err = toFloat64(config.GetDefault("http_timeout", 10.0))
+	if err != nil {
+		return nil, tomlError(err, config, "http_timeout")
+	}
 	var rules struct {
-		Rule []rule
+		Rule      []rule
+		AllowHost []string       `toml:"allow_host"`
+		Source    []sourceConfig `toml:"source"`
 	}
 	err = config.Unmarshal(&rules)
 	if err != nil {
 		return nil, tomlError(err, config, "rule")
 	}
 	s.Rule = rules.Rule
+	s.AllowHost = rules.AllowHost
+	s.Source = rules.Source
+	s.fs, err = newUnionFS(afero.NewOsFs(), s.Source)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not set up source filesystems")
+	}
 	for i := range s.Rule {
 		r := &s.Rule[i]
 		r.Dir = strings.NewReplacer("%BASEDIR%", s.BaseDir).Replace(r.Dir)
+		r.dirRE, err = makeDirMatcher(r.Dir, r.Recursive, r.Depth)
+		if err != nil {
+			return nil, err
+		}
 		r.fileRE, err = makeWildcard(r.File)
 		if err != nil {
 			return nil, err
@@ -160,12 +269,48 @@ var (
 	utf16be  = unicode.UTF16(unicode.BigEndian, unicode.UseBOM)
 )
 
-func (ss *setting) Find(path string) (*rule, string, error) {
-	dir := filepath.Dir(path)
-	base := filepath.Base(path)
-	textRaw, err := ioutil.ReadFile(path[:len(path)-4] + ".txt")
+// FS returns the unioned filesystem that Find and the Lua helpers read
+// through: the real OS filesystem plus any [[source]] roots from
+// setting.toml.
+func (ss *setting) FS() afero.Fs {
+	return ss.fs
+}
+
+// Close releases any resources held by ss.fs's [[source]] roots (e.g. open
+// zip archive files). Safe to call on a *setting whose fs isn't a
+// *unionFs (e.g. in tests that set fs directly to an afero.Fs).
+func (ss *setting) Close() error {
+	if u, ok := ss.fs.(*unionFs); ok {
+		return u.Close()
+	}
+	return nil
+}
+
+// sourceOf reports the [[source]] name that path addresses (via a "name:"
+// VFS URI prefix), and path relative to that source's root. It returns
+// ("", path, false) for a plain filesystem path, i.e. one served by the
+// default/local root.
+func (ss *setting) sourceOf(path string) (name, rel string, ok bool) {
+	u, isUnion := ss.fs.(*unionFs)
+	if !isUnion {
+		return "", path, false
+	}
+	return u.SourceOf(path)
+}
+
+func (ss *setting) Find(path string) (*rule, string, map[string]string, error) {
+	srcName, rel, _ := ss.sourceOf(path)
+	// rule.Dir matching happens relative to the rule's own source root
+	// (empty Source means the default/local root), so strip the "name:"
+	// VFS prefix before comparing directories. filepath.Dir returns
+	// OS-native separators (backslashes on Windows, this tool's primary
+	// target), but dirRE is built from forward-slash-only patterns, so
+	// normalize before matching.
+	dir := filepath.ToSlash(filepath.Dir(rel))
+	base := filepath.Base(rel)
+	textRaw, err := afero.ReadFile(ss.fs, strings.TrimSuffix(path, filepath.Ext(path))+".txt")
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, err
 	}
 	var u8, sjis, u16le, u16be *string
 
@@ -174,14 +319,33 @@ func (ss *setting) Find(path string) (*rule, string, error) {
 			log.Println("[INFO] ", i, "番目のルールを検証中...")
 		}
 		r := &ss.Rule[i]
-		if dir != r.Dir {
+		if r.Source != srcName {
+			if verbose {
+				log.Println("[INFO]   ソースが一致しません")
+				log.Println("[INFO]     want:", r.Source)
+				log.Println("[INFO]     got:", srcName)
+			}
+			continue
+		}
+		m := r.dirRE.FindStringSubmatch(dir)
+		if m == nil {
 			if verbose {
 				log.Println("[INFO]   フォルダーのパスが一致しません")
-				log.Println("[INFO]     want:", r.Dir)
+				log.Println("[INFO]     want:", r.dirRE)
 				log.Println("[INFO]     got:", dir)
 			}
 			continue
 		}
+		var groups map[string]string
+		if len(m) > 1 {
+			groups = make(map[string]string, len(m)-1)
+			for gi, name := range r.dirRE.SubexpNames() {
+				if gi == 0 || name == "" {
+					continue
+				}
+				groups[name] = m[gi]
+			}
+		}
 		if !r.fileRE.MatchString(base) {
 			if verbose {
 				log.Println("[INFO]   ファイル名がワイルドカードに一致しません")
@@ -271,57 +435,135 @@ func (ss *setting) Find(path string) (*rule, string, error) {
 				t := string(skipUTF8BOM(textRaw))
 				u8 = &t
 			}
-			return r, *u8, nil
+			return r, *u8, groups, nil
 		case "sjis":
 			if sjis == nil {
 				b, err := shiftjis.NewDecoder().Bytes(textRaw)
 				if err != nil {
-					return nil, "", errors.Wrap(err, "cannot convert encoding to shift_jis")
+					return nil, "", nil, errors.Wrap(err, "cannot convert encoding to shift_jis")
 				}
 				t := string(b)
 				sjis = &t
 			}
-			return r, *sjis, nil
+			return r, *sjis, groups, nil
 		case "utf16le":
 			if u16le == nil {
 				b, err := utf16le.NewDecoder().Bytes(textRaw)
 				if err != nil {
-					return nil, "", errors.Wrap(err, "cannot convert encoding to utf-16le")
+					return nil, "", nil, errors.Wrap(err, "cannot convert encoding to utf-16le")
 				}
 				t := string(b)
 				u16le = &t
 			}
-			return r, *u16le, nil
+			return r, *u16le, groups, nil
 		case "utf16be":
 			if u16be == nil {
 				b, err := utf16be.NewDecoder().Bytes(textRaw)
 				if err != nil {
-					return nil, "", errors.Wrap(err, "cannot convert encoding to utf-16be")
+					return nil, "", nil, errors.Wrap(err, "cannot convert encoding to utf-16be")
 				}
 				t := string(b)
 				u16be = &t
 			}
-			return r, *u16be, nil
+			return r, *u16be, groups, nil
 		default:
 			panic("unexcepted encoding value: " + r.Encoding)
 		}
 	}
-	return nil, "", nil
+	return nil, "", nil, nil
 }
 
-func (ss *setting) Dirs() []string {
-	dirs := map[string]struct{}{}
-	for i := range ss.Rule {
-		dirs[ss.Rule[i].Dir] = struct{}{}
+// dirPrefix returns the longest literal (wildcard-free) leading portion of
+// a rule's directory pattern, used as the concrete folder to watch when the
+// rule itself matches a whole subtree.
+func dirPrefix(dir string) string {
+	segs := strings.Split(filepath.ToSlash(dir), "/")
+	for i, seg := range segs {
+		if seg == "**" || strings.ContainsAny(seg, "*?") {
+			return filepath.FromSlash(strings.Join(segs[:i], "/"))
+		}
+	}
+	return filepath.FromSlash(dir)
+}
+
+// isSubDir reports whether child is parent or nested inside it.
+func isSubDir(parent, child string) bool {
+	if parent == child {
+		return true
 	}
+	rel, err := filepath.Rel(parent, child)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// shortestCommonAncestors drops any path that is nested inside another path
+// already present in dirs, so the watcher only needs to observe the
+// outermost folder of each rule tree.
+func shortestCommonAncestors(dirs []string) []string {
 	r := make([]string, 0, len(dirs))
-	for k := range dirs {
-		r = append(r, k)
+	for _, d := range dirs {
+		nested := false
+		for _, other := range dirs {
+			if other != d && isSubDir(other, d) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			r = append(r, d)
+		}
 	}
-	sort.Strings(r)
 	return r
 }
 
+// Dirs returns the shortest-common-ancestor folders the watcher needs to
+// observe: plain filesystem paths for rules with no Source, and
+// "name:path" VFS URIs (reduced independently per source) for rules tied
+// to a [[source]] root, so every registered source is unioned into the
+// watcher alongside the default tree.
+func (ss *setting) Dirs() []string {
+	local := map[string]struct{}{}
+	bySource := map[string]map[string]struct{}{}
+	for i := range ss.Rule {
+		r := &ss.Rule[i]
+		prefix := dirPrefix(r.Dir)
+		if r.Source == "" {
+			local[prefix] = struct{}{}
+			continue
+		}
+		if bySource[r.Source] == nil {
+			bySource[r.Source] = map[string]struct{}{}
+		}
+		bySource[r.Source][prefix] = struct{}{}
+	}
+
+	localList := make([]string, 0, len(local))
+	for k := range local {
+		localList = append(localList, k)
+	}
+	sort.Strings(localList)
+	result := shortestCommonAncestors(localList)
+
+	sourceNames := make([]string, 0, len(bySource))
+	for name := range bySource {
+		sourceNames = append(sourceNames, name)
+	}
+	sort.Strings(sourceNames)
+	for _, name := range sourceNames {
+		list := make([]string, 0, len(bySource[name]))
+		for k := range bySource[name] {
+			list = append(list, k)
+		}
+		sort.Strings(list)
+		for _, d := range shortestCommonAncestors(list) {
+			result = append(result, name+":"+d)
+		}
+	}
+	return result
+}
+
 func loadTOML(path string) (*toml.Tree, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
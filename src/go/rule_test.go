@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestMakeDirMatcher(t *testing.T) {
+	cases := []struct {
+		name      string
+		dir       string
+		recursive bool
+		depth     int
+		match     []string
+		noMatch   []string
+	}{
+		{
+			name:  "trailing **",
+			dir:   "chara/**",
+			match: []string{"chara", "chara/a", "chara/a/b"},
+			noMatch: []string{
+				"char", "chara2", "other",
+			},
+		},
+		{
+			name:  "middle **",
+			dir:   "chara/**/take_*",
+			match: []string{"chara/take_foo", "chara/a/take_foo", "chara/a/b/take_foo"},
+			noMatch: []string{
+				"chara/take", "chara", "other/take_foo",
+			},
+		},
+		{
+			name:  "leading **",
+			dir:   "**/take_*",
+			match: []string{"take_foo", "a/take_foo", "a/b/take_foo"},
+			noMatch: []string{
+				"other/foo",
+			},
+		},
+		{
+			name:      "recursive flag appends trailing recursion",
+			dir:       "chara",
+			recursive: true,
+			match:     []string{"chara", "chara/a", "chara/a/b"},
+			noMatch:   []string{"char", "other"},
+		},
+		{
+			name:  "bounded depth limits nesting",
+			dir:   "chara/**",
+			depth: 1,
+			match: []string{"chara", "chara/a"},
+			noMatch: []string{
+				"chara/a/b",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			re, err := makeDirMatcher(c.dir, c.recursive, c.depth)
+			if err != nil {
+				t.Fatalf("makeDirMatcher(%q) error: %v", c.dir, err)
+			}
+			for _, m := range c.match {
+				if !re.MatchString(m) {
+					t.Errorf("%q: expected %q to match %s", c.dir, m, re)
+				}
+			}
+			for _, m := range c.noMatch {
+				if re.MatchString(m) {
+					t.Errorf("%q: expected %q not to match %s", c.dir, m, re)
+				}
+			}
+		})
+	}
+}
+
+func TestShortestCommonAncestors(t *testing.T) {
+	in := []string{"chara", "chara/a", "other", "other/b/c"}
+	got := shortestCommonAncestors(in)
+	want := map[string]bool{"chara": true, "other": true}
+	if len(got) != len(want) {
+		t.Fatalf("shortestCommonAncestors(%v) = %v, want %v", in, got, want)
+	}
+	for _, d := range got {
+		if !want[d] {
+			t.Errorf("unexpected ancestor %q in %v", d, got)
+		}
+	}
+}
+
+// TestFindMatchesSourceRoot exercises a rule whose Source ties it to a
+// [[source]] root: rule.Dir must be matched relative to that source's own
+// tree, not the "name:" VFS URI used to address it.
+func TestFindMatchesSourceRoot(t *testing.T) {
+	archive := afero.NewMemMapFs()
+	if err := afero.WriteFile(archive, "chara/take_01.wav", []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(archive, "chara/take_01.txt", []byte("line"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	u, err := newUnionFS(afero.NewMemMapFs(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.named["archive"] = archive
+
+	r := rule{Dir: "chara", File: "*.wav", Encoding: "utf8", Source: "archive"}
+	var errMk error
+	r.dirRE, errMk = makeDirMatcher(r.Dir, r.Recursive, r.Depth)
+	if errMk != nil {
+		t.Fatal(errMk)
+	}
+	r.fileRE, errMk = makeWildcard(r.File)
+	if errMk != nil {
+		t.Fatal(errMk)
+	}
+
+	s := &setting{fs: u, Rule: []rule{r}}
+	got, _, _, err := s.Find("archive:chara/take_01.wav")
+	if err != nil {
+		t.Fatalf("Find returned error: %v", err)
+	}
+	if got == nil {
+		t.Fatal("Find did not match the rule tied to the source root")
+	}
+
+	// A rule with no Source must not match a path from a [[source]] root.
+	local := rule{Dir: "chara", File: "*.wav"}
+	local.dirRE, _ = makeDirMatcher(local.Dir, local.Recursive, local.Depth)
+	local.fileRE, _ = makeWildcard(local.File)
+	s.Rule = []rule{local}
+	got, _, _, err = s.Find("archive:chara/take_01.wav")
+	if err != nil {
+		t.Fatalf("Find returned error: %v", err)
+	}
+	if got != nil {
+		t.Fatal("a Source-less rule matched a path from a [[source]] root")
+	}
+}
+
+// TestFindSidecarExtensionLongerThanFour guards against assuming a 4-char
+// audio extension when deriving the sidecar .txt path: "voice.flac"[:len-4]
+// would wrongly chop into "voice." instead of "voice".
+func TestFindSidecarExtensionLongerThanFour(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := afero.WriteFile(fs, "chara/voice.flac", []byte("audio"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(fs, "chara/voice.txt", []byte("line"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := rule{Dir: "chara", File: "*.flac", Encoding: "utf8"}
+	var err error
+	r.dirRE, err = makeDirMatcher(r.Dir, r.Recursive, r.Depth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.fileRE, err = makeWildcard(r.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &setting{fs: fs, Rule: []rule{r}}
+	got, _, _, err := s.Find("chara/voice.flac")
+	if err != nil {
+		t.Fatalf("Find returned error: %v", err)
+	}
+	if got == nil {
+		t.Fatal("Find did not match a .flac file because its sidecar .txt lookup was mis-truncated")
+	}
+}
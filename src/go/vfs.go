@@ -0,0 +1,281 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/spf13/afero/zipfs"
+)
+
+// sourceConfig is one [[source]] entry in setting.toml: an additional root
+// that is unioned into the filesystem rule.Dir is matched against and that
+// the Lua helpers read through, so batches can be processed straight out
+// of a ZIP archive or a read-only network share without unpacking first.
+type sourceConfig struct {
+	Name string
+	Type string // "local" (default), "zip", or "http"
+	Root string
+}
+
+// buildSourceFS resolves one sourceConfig into the afero.Fs that serves it,
+// plus the underlying io.Closer the caller must close when the setting is
+// torn down or reloaded ("zip" keeps its backing *os.File open for the
+// lifetime of the zip.Reader; other types have nothing to close).
+func buildSourceFS(c sourceConfig) (afero.Fs, io.Closer, error) {
+	switch c.Type {
+	case "", "local":
+		return afero.NewBasePathFs(afero.NewOsFs(), c.Root), nil, nil
+	case "zip":
+		f, err := os.Open(c.Root)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "could not open zip source %q", c.Name)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, errors.Wrapf(err, "could not stat zip source %q", c.Name)
+		}
+		zr, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			f.Close()
+			return nil, nil, errors.Wrapf(err, "could not read zip source %q", c.Name)
+		}
+		return zipfs.New(zr), f, nil
+	case "http":
+		return newHTTPFs(c.Root), nil, nil
+	default:
+		return nil, nil, errors.Errorf("unknown source type %q for source %q", c.Type, c.Name)
+	}
+}
+
+// unionFs dispatches to one of several named afero.Fs roots, chosen by a
+// "name:relative/path" VFS URI; a path without a recognized "name:" prefix
+// (including a real OS path, e.g. a Windows drive letter) falls through to
+// def, the default root used before [[source]] existed.
+type unionFs struct {
+	def     afero.Fs
+	named   map[string]afero.Fs
+	closers []io.Closer
+}
+
+func newUnionFS(def afero.Fs, sources []sourceConfig) (*unionFs, error) {
+	u := &unionFs{def: def, named: make(map[string]afero.Fs, len(sources))}
+	for _, c := range sources {
+		fs, closer, err := buildSourceFS(c)
+		if err != nil {
+			u.Close()
+			return nil, err
+		}
+		u.named[c.Name] = fs
+		if closer != nil {
+			u.closers = append(u.closers, closer)
+		}
+	}
+	return u, nil
+}
+
+// Close releases the resources backing any [[source]] roots (currently
+// just the open zip archive files), so reloading setting.toml doesn't leak
+// a file handle per zip source.
+func (u *unionFs) Close() error {
+	var firstErr error
+	for _, c := range u.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SourceOf reports the named source that p addresses via a "name:"
+// VFS-URI prefix, and p with that prefix stripped. ok is false when p
+// carries no recognized source prefix (including a real OS path that
+// happens to contain ":", e.g. a Windows drive letter), in which case rel
+// is just p and it should be served from the default root.
+func (u *unionFs) SourceOf(p string) (name, rel string, ok bool) {
+	if i := strings.Index(p, ":"); i > 0 {
+		if _, known := u.named[p[:i]]; known {
+			return p[:i], p[i+1:], true
+		}
+	}
+	return "", p, false
+}
+
+func (u *unionFs) resolve(p string) (afero.Fs, string) {
+	if name, rel, ok := u.SourceOf(p); ok {
+		return u.named[name], rel
+	}
+	return u.def, p
+}
+
+func (u *unionFs) Create(name string) (afero.File, error) {
+	fs, p := u.resolve(name)
+	return fs.Create(p)
+}
+
+func (u *unionFs) Mkdir(name string, perm os.FileMode) error {
+	fs, p := u.resolve(name)
+	return fs.Mkdir(p, perm)
+}
+
+func (u *unionFs) MkdirAll(path string, perm os.FileMode) error {
+	fs, p := u.resolve(path)
+	return fs.MkdirAll(p, perm)
+}
+
+func (u *unionFs) Open(name string) (afero.File, error) {
+	fs, p := u.resolve(name)
+	return fs.Open(p)
+}
+
+func (u *unionFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fs, p := u.resolve(name)
+	return fs.OpenFile(p, flag, perm)
+}
+
+func (u *unionFs) Remove(name string) error {
+	fs, p := u.resolve(name)
+	return fs.Remove(p)
+}
+
+func (u *unionFs) RemoveAll(path string) error {
+	fs, p := u.resolve(path)
+	return fs.RemoveAll(p)
+}
+
+func (u *unionFs) Rename(oldname, newname string) error {
+	fs, oldp := u.resolve(oldname)
+	_, newp := u.resolve(newname)
+	return fs.Rename(oldp, newp)
+}
+
+func (u *unionFs) Stat(name string) (os.FileInfo, error) {
+	fs, p := u.resolve(name)
+	return fs.Stat(p)
+}
+
+func (u *unionFs) Name() string {
+	return "unionFs"
+}
+
+func (u *unionFs) Chmod(name string, mode os.FileMode) error {
+	fs, p := u.resolve(name)
+	return fs.Chmod(p, mode)
+}
+
+func (u *unionFs) Chtimes(name string, atime, mtime time.Time) error {
+	fs, p := u.resolve(name)
+	return fs.Chtimes(p, atime, mtime)
+}
+
+func (u *unionFs) Chown(name string, uid, gid int) error {
+	fs, p := u.resolve(name)
+	return fs.Chown(p, uid, gid)
+}
+
+var errHTTPSourceReadOnly = errors.New("http source is read-only")
+
+// httpFs is a minimal read-only afero.Fs that serves files by GETing
+// base+"/"+name from a remote root, for a [[source]] with type = "http".
+type httpFs struct {
+	base string
+}
+
+func newHTTPFs(base string) *httpFs {
+	return &httpFs{base: strings.TrimRight(base, "/")}
+}
+
+func (h *httpFs) url(name string) string {
+	return h.base + "/" + strings.TrimLeft(path.Clean("/"+name), "/")
+}
+
+func (h *httpFs) Open(name string) (afero.File, error) {
+	resp, err := http.Get(h.url(name))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.Errorf("http status %d", resp.StatusCode)}
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &httpFile{name: name, Reader: bytes.NewReader(b)}, nil
+}
+
+func (h *httpFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	return h.Open(name)
+}
+
+func (h *httpFs) Stat(name string) (os.FileInfo, error) {
+	resp, err := http.Head(h.url(name))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: errors.Errorf("http status %d", resp.StatusCode)}
+	}
+	return httpFileInfo{name: name, size: resp.ContentLength}, nil
+}
+
+func (h *httpFs) Name() string { return "httpFs(" + h.base + ")" }
+
+func (h *httpFs) Create(name string) (afero.File, error)       { return nil, errHTTPSourceReadOnly }
+func (h *httpFs) Mkdir(name string, perm os.FileMode) error    { return errHTTPSourceReadOnly }
+func (h *httpFs) MkdirAll(path string, perm os.FileMode) error { return errHTTPSourceReadOnly }
+func (h *httpFs) Remove(name string) error                     { return errHTTPSourceReadOnly }
+func (h *httpFs) RemoveAll(path string) error                  { return errHTTPSourceReadOnly }
+func (h *httpFs) Rename(oldname, newname string) error         { return errHTTPSourceReadOnly }
+func (h *httpFs) Chmod(name string, mode os.FileMode) error    { return errHTTPSourceReadOnly }
+func (h *httpFs) Chtimes(name string, atime, mtime time.Time) error {
+	return errHTTPSourceReadOnly
+}
+func (h *httpFs) Chown(name string, uid, gid int) error { return errHTTPSourceReadOnly }
+
+// httpFile is the read-only afero.File handle returned by httpFs.Open: the
+// whole response body, buffered so it can be sought like a local file.
+type httpFile struct {
+	name string
+	*bytes.Reader
+}
+
+func (f *httpFile) Close() error { return nil }
+func (f *httpFile) Name() string { return f.name }
+func (f *httpFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, errors.New("http source file is not a directory")
+}
+func (f *httpFile) Readdirnames(n int) ([]string, error) {
+	return nil, errors.New("http source file is not a directory")
+}
+func (f *httpFile) Stat() (os.FileInfo, error) {
+	return httpFileInfo{name: f.name, size: f.Reader.Size()}, nil
+}
+func (f *httpFile) Sync() error                             { return nil }
+func (f *httpFile) Truncate(size int64) error                { return errHTTPSourceReadOnly }
+func (f *httpFile) Write(p []byte) (int, error)              { return 0, errHTTPSourceReadOnly }
+func (f *httpFile) WriteAt(p []byte, off int64) (int, error) { return 0, errHTTPSourceReadOnly }
+func (f *httpFile) WriteString(s string) (int, error)        { return 0, errHTTPSourceReadOnly }
+
+type httpFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi httpFileInfo) Name() string       { return path.Base(fi.name) }
+func (fi httpFileInfo) Size() int64        { return fi.size }
+func (fi httpFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi httpFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi httpFileInfo) IsDir() bool        { return false }
+func (fi httpFileInfo) Sys() interface{}   { return nil }
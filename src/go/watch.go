@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// settingWatcher keeps *setting and the Lua script that accompanies it
+// (the one registered with luaFindRule) hot-reloadable: edits to
+// setting.toml or setup.lua are picked up and atomically swapped in for
+// subsequent Find calls, without restarting the process.
+type settingWatcher struct {
+	settingPath string
+	luaPath     string
+
+	cur atomic.Value // *setting
+
+	luaMu sync.Mutex
+	L     *lua.LState
+
+	watcher *fsnotify.Watcher
+}
+
+// newSettingWatcher loads settingPath/luaPath once and starts watching both
+// files for changes.
+func newSettingWatcher(settingPath, luaPath string) (*settingWatcher, error) {
+	s, err := newSetting(settingPath)
+	if err != nil {
+		return nil, err
+	}
+	L, err := newLuaState(s, luaPath)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create file watcher")
+	}
+	// Watch the containing directories rather than the files themselves:
+	// editors commonly save via atomic rename, which replaces the watched
+	// inode out from under a direct file watch (fsnotify then delivers a
+	// Rename/Remove instead of the Write this loop expects, and the watch
+	// goes stale for good). Watching the directory and filtering by
+	// basename in loop survives that.
+	dirs := map[string]struct{}{filepath.Dir(settingPath): {}, filepath.Dir(luaPath): {}}
+	for dir := range dirs {
+		if err = w.Add(dir); err != nil {
+			return nil, errors.Wrapf(err, "could not watch directory %q", dir)
+		}
+	}
+	sw := &settingWatcher{
+		settingPath: settingPath,
+		luaPath:     luaPath,
+		L:           L,
+		watcher:     w,
+	}
+	sw.cur.Store(s)
+	go sw.loop()
+	return sw, nil
+}
+
+// newLuaState creates a fresh *lua.LState with the usual helpers registered
+// against s, then loads luaPath into it.
+func newLuaState(s *setting, luaPath string) (*lua.LState, error) {
+	L := lua.NewState()
+	L.SetGlobal("debugPrint", L.NewFunction(luaDebugPrint))
+	L.SetGlobal("findRule", L.NewFunction(luaFindRule(s)))
+	L.SetGlobal("getAudioInfo", L.NewFunction(luaGetAudioInfo(s)))
+	L.SetGlobal("toSJIS", L.NewFunction(luaToSJIS))
+	L.SetGlobal("fromSJIS", L.NewFunction(luaFromSJIS))
+	L.SetGlobal("toEXOString", L.NewFunction(luaToEXOString))
+	registerLuaHTTP(L, s)
+	registerLuaJSON(L)
+	if err := L.DoFile(luaPath); err != nil {
+		L.Close()
+		return nil, errors.Wrap(err, "could not load lua script")
+	}
+	return L, nil
+}
+
+func (sw *settingWatcher) loop() {
+	for {
+		select {
+		case ev, ok := <-sw.watcher.Events:
+			if !ok {
+				return
+			}
+			// An atomic-rename save delivers Rename/Remove for the old
+			// inode, not Write, but the new file at the same path still
+			// needs to be picked up, so treat those the same as Write.
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+				continue
+			}
+			switch filepath.Base(ev.Name) {
+			case filepath.Base(sw.settingPath):
+				sw.reloadSetting()
+			case filepath.Base(sw.luaPath):
+				sw.reloadLua()
+			}
+		case err, ok := <-sw.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("[ERROR] 設定ファイルの監視中にエラーが発生しました: ", err)
+		}
+	}
+}
+
+// reloadSetting re-parses setting.toml and recreates the Lua state against
+// it. On failure the previous good *setting and Lua state are kept in
+// place and the error is logged.
+func (sw *settingWatcher) reloadSetting() {
+	s, err := newSetting(sw.settingPath)
+	if err != nil {
+		log.Println("[ERROR] setting.toml の再読み込みに失敗しました。直前の設定を使い続けます: ", err)
+		return
+	}
+	sw.luaMu.Lock()
+	defer sw.luaMu.Unlock()
+	L, err := newLuaState(s, sw.luaPath)
+	if err != nil {
+		log.Println("[ERROR] setup.lua の再読み込みに失敗しました。直前の設定を使い続けます: ", err)
+		s.Close()
+		return
+	}
+	oldL := sw.L
+	oldSetting := sw.Setting()
+	sw.L = L
+	sw.cur.Store(s)
+	oldL.Close()
+	oldSetting.Close()
+	if verbose {
+		log.Println("[INFO] setting.toml を再読み込みしました")
+	}
+}
+
+// reloadLua recreates the Lua state against the currently active *setting.
+// On failure the previous Lua state is kept in place and the error is
+// logged.
+func (sw *settingWatcher) reloadLua() {
+	s := sw.Setting()
+	sw.luaMu.Lock()
+	defer sw.luaMu.Unlock()
+	L, err := newLuaState(s, sw.luaPath)
+	if err != nil {
+		log.Println("[ERROR] setup.lua の再読み込みに失敗しました。直前のスクリプトを使い続けます: ", err)
+		return
+	}
+	old := sw.L
+	sw.L = L
+	old.Close()
+	if verbose {
+		log.Println("[INFO] setup.lua を再読み込みしました")
+	}
+}
+
+// Setting returns the currently active *setting. Safe for concurrent use
+// with reloads.
+func (sw *settingWatcher) Setting() *setting {
+	return sw.cur.Load().(*setting)
+}
+
+// Find matches path against the currently active setting.
+func (sw *settingWatcher) Find(path string) (*rule, string, map[string]string, error) {
+	return sw.Setting().Find(path)
+}
+
+// Lua runs fn with the current Lua state, serialized against an in-flight
+// reload. fn must not retain the *lua.LState it is given.
+func (sw *settingWatcher) Lua(fn func(*lua.LState)) {
+	sw.luaMu.Lock()
+	defer sw.luaMu.Unlock()
+	fn(sw.L)
+}
+
+func (sw *settingWatcher) Close() error {
+	sw.Setting().Close()
+	return sw.watcher.Close()
+}